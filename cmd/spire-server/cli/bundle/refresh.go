@@ -0,0 +1,271 @@
+package bundle
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/mitchellh/cli"
+	"github.com/spiffe/spire/pkg/common/idutil"
+	"github.com/spiffe/spire/proto/api/registration"
+)
+
+// endpointProfile identifies how "bundle refresh" authenticates the peer's
+// SPIFFE bundle endpoint, per the SPIFFE Federation profiles.
+type endpointProfile string
+
+const (
+	// profileHTTPSWeb validates the endpoint's server certificate against
+	// the system's trusted root CAs, like a normal HTTPS client.
+	profileHTTPSWeb endpointProfile = "https_web"
+
+	// profileHTTPSSPIFFE validates the endpoint's server certificate
+	// against the SPIFFE bundle already on file for the endpoint's trust
+	// domain, and rotates that bundle in place once a refresh succeeds.
+	profileHTTPSSPIFFE endpointProfile = "https_spiffe"
+
+	// requestTimeout bounds a single refresh pull, so a hung endpoint
+	// can't block refreshOnce indefinitely and starve -interval mode of
+	// its next tick.
+	requestTimeout = 30 * time.Second
+)
+
+// NewRefreshCommand creates a new "refresh" subcommand for "bundle" command.
+func NewRefreshCommand() cli.Command {
+	return newRefreshCommand(defaultEnv, newClients)
+}
+
+func newRefreshCommand(env *env, clientsMaker clientsMaker) cli.Command {
+	return adaptCommand(env, clientsMaker, new(refreshCommand))
+}
+
+type refreshCommand struct {
+	// SPIFFE ID of the trust domain to refresh
+	id string
+
+	// HTTPS URL of the peer's SPIFFE bundle endpoint
+	endpoint string
+
+	// Endpoint authentication profile: https_web or https_spiffe
+	profile string
+
+	// SPIFFE ID the bundle endpoint itself is expected to present, e.g.
+	// "spiffe://example.org/spire/server". Required for -profile
+	// https_spiffe, since the endpoint's X.509-SVID asserts its own
+	// identity, not the trust domain's bare root ID.
+	endpointSpiffeID string
+
+	// When set, keep refreshing on this interval instead of exiting after
+	// a single pull, so the command can run as a sidecar.
+	interval time.Duration
+}
+
+func (c *refreshCommand) name() string {
+	return "bundle refresh"
+}
+
+func (c *refreshCommand) synopsis() string {
+	return "Refreshes a federated bundle from a SPIFFE bundle endpoint"
+}
+
+func (c *refreshCommand) appendFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.id, "id", "", "SPIFFE ID of the trust domain")
+	fs.StringVar(&c.endpoint, "endpoint", "", "HTTPS URL of the peer's SPIFFE bundle endpoint")
+	fs.StringVar(&c.profile, "profile", string(profileHTTPSWeb), "Endpoint authentication profile (https_web or https_spiffe)")
+	fs.StringVar(&c.endpointSpiffeID, "endpointSpiffeID", "", "SPIFFE ID the bundle endpoint is expected to present (required for -profile https_spiffe)")
+	fs.DurationVar(&c.interval, "interval", 0, "If set, keep refreshing the bundle on this interval instead of exiting after one pull")
+}
+
+func (c *refreshCommand) run(ctx context.Context, env *env, clients *clients) error {
+	if c.id == "" {
+		return errors.New("id is required")
+	}
+	if c.endpoint == "" {
+		return errors.New("endpoint is required")
+	}
+	id, err := idutil.NormalizeSpiffeID(c.id, idutil.AllowAnyTrustDomain())
+	if err != nil {
+		return err
+	}
+
+	profile := endpointProfile(c.profile)
+	var endpointSpiffeID string
+	switch profile {
+	case profileHTTPSWeb:
+	case profileHTTPSSPIFFE:
+		if c.endpointSpiffeID == "" {
+			return errors.New("endpointSpiffeID is required for -profile https_spiffe")
+		}
+		endpointSpiffeID, err = idutil.NormalizeSpiffeID(c.endpointSpiffeID, idutil.AllowAnyTrustDomain())
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown profile %q", c.profile)
+	}
+
+	if c.interval <= 0 {
+		return c.refreshOnce(ctx, env, clients, id, profile, endpointSpiffeID)
+	}
+
+	for {
+		if err := c.refreshOnce(ctx, env, clients, id, profile, endpointSpiffeID); err != nil {
+			env.Println(fmt.Sprintf("failed to refresh bundle for %q: %v", id, err))
+		}
+		select {
+		case <-time.After(c.interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *refreshCommand) refreshOnce(ctx context.Context, env *env, clients *clients, id string, profile endpointProfile, endpointSpiffeID string) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	httpClient, err := c.buildHTTPClient(ctx, clients, id, profile, endpointSpiffeID)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("unable to fetch bundle endpoint: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bundle endpoint returned status %d", resp.StatusCode)
+	}
+
+	bundleData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read bundle endpoint response: %v", err)
+	}
+
+	caCerts, jwtSigningKeys, err := parseSPIFFEBundle(bundleData)
+	if err != nil {
+		return fmt.Errorf("invalid bundle data: %v", err)
+	}
+
+	bundle := &registration.FederatedBundle{
+		DEPRECATEDSpiffeId: id,
+		DEPRECATEDCaCerts:  caCerts,
+		JwtSigningKeys:     jwtSigningKeys,
+	}
+
+	// pull the existing bundle to know if this should be a create or an
+	// update, same as "bundle set".
+	_, err = clients.r.FetchFederatedBundle(ctx, &registration.FederatedBundleID{
+		Id: id,
+	})
+	if err == nil {
+		_, err = clients.r.UpdateFederatedBundle(ctx, bundle)
+	} else {
+		_, err = clients.r.CreateFederatedBundle(ctx, bundle)
+	}
+	if err != nil {
+		return err
+	}
+
+	return env.Println(fmt.Sprintf("bundle refreshed for %q.", id))
+}
+
+// buildHTTPClient returns an HTTP client that authenticates the bundle
+// endpoint according to the configured profile. endpointSpiffeID is the
+// SPIFFE ID the endpoint itself is expected to present and is only used
+// (and only set) for the https_spiffe profile.
+func (c *refreshCommand) buildHTTPClient(ctx context.Context, clients *clients, id string, profile endpointProfile, endpointSpiffeID string) (*http.Client, error) {
+	if profile == profileHTTPSWeb {
+		return http.DefaultClient, nil
+	}
+
+	// https_spiffe: validate the endpoint's certificate against the SPIFFE
+	// bundle already on file for this trust domain. If the refresh below
+	// succeeds, that bundle is rotated in place, so the next refresh trusts
+	// whatever authorities the peer just published.
+	existing, err := clients.r.FetchFederatedBundle(ctx, &registration.FederatedBundleID{
+		Id: id,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("no local SPIFFE bundle known for %q to validate the endpoint against: %v", id, err)
+	}
+
+	certs, err := x509.ParseCertificates(existing.DEPRECATEDCaCerts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse local SPIFFE bundle for %q: %v", id, err)
+	}
+	roots := x509.NewCertPool()
+	for _, cert := range certs {
+		roots.AddCert(cert)
+	}
+
+	// A SPIFFE X.509-SVID presents its identity as a URI SAN
+	// (spiffe://...), not a DNS SAN, so Go's stock hostname verification
+	// would reject a perfectly legitimate endpoint. Skip it and do the
+	// SPIFFE-style verification ourselves instead: chain the presented
+	// leaf to the trust domain's bundle, then check that it asserts the
+	// endpoint's own SPIFFE ID (a workload ID under the trust domain, not
+	// the trust domain's bare root), same as go-spiffe/SPIRE do for the
+	// https_spiffe profile.
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify:    true,
+				VerifyPeerCertificate: verifySPIFFEPeerCertificate(roots, endpointSpiffeID),
+			},
+		},
+	}, nil
+}
+
+// verifySPIFFEPeerCertificate returns a tls.Config.VerifyPeerCertificate
+// callback implementing the https_spiffe bundle endpoint profile: the
+// endpoint's leaf certificate must chain to trustedRoots and must present
+// expectedID as a URI SAN.
+func verifySPIFFEPeerCertificate(trustedRoots *x509.CertPool, expectedID string) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("bundle endpoint presented no certificate")
+		}
+
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, rawCert := range rawCerts {
+			cert, err := x509.ParseCertificate(rawCert)
+			if err != nil {
+				return fmt.Errorf("unable to parse bundle endpoint certificate: %v", err)
+			}
+			certs = append(certs, cert)
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		leaf := certs[0]
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         trustedRoots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			return fmt.Errorf("bundle endpoint certificate does not chain to the local SPIFFE bundle for %q: %v", expectedID, err)
+		}
+
+		for _, uri := range leaf.URIs {
+			if uri.String() == expectedID {
+				return nil
+			}
+		}
+		return fmt.Errorf("bundle endpoint certificate does not assert the expected SPIFFE ID %q", expectedID)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/spiffe/spire/pkg/common/idutil"
 	"github.com/spiffe/spire/pkg/common/pemutil"
 	"github.com/spiffe/spire/proto/api/registration"
+	"github.com/spiffe/spire/proto/common"
 )
 
 // NewSetCommand creates a new "set" subcommand for "bundle" command.
@@ -21,12 +22,24 @@ func newSetCommand(env *env, clientsMaker clientsMaker) cli.Command {
 	return adaptCommand(env, clientsMaker, new(setCommand))
 }
 
+// bundleFormat identifies the on-disk encoding of the bundle data passed to
+// "bundle set".
+type bundleFormat string
+
+const (
+	formatPEM    bundleFormat = "pem"
+	formatSPIFFE bundleFormat = "spiffe"
+)
+
 type setCommand struct {
 	// SPIFFE ID of the trust bundle
 	id string
 
 	// Path to the bundle on disk (optional). If empty, reads from stdin.
 	path string
+
+	// Format of the bundle data: "pem" (default) or "spiffe"
+	format string
 }
 
 func (c *setCommand) name() string {
@@ -40,6 +53,7 @@ func (c *setCommand) synopsis() string {
 func (c *setCommand) appendFlags(fs *flag.FlagSet) {
 	fs.StringVar(&c.id, "id", "", "SPIFFE ID of the trust domain")
 	fs.StringVar(&c.path, "path", "", "Path to the bundle data")
+	fs.StringVar(&c.format, "format", string(formatPEM), "Format of the bundle data (pem or spiffe)")
 }
 
 func (c *setCommand) run(ctx context.Context, env *env, clients *clients) error {
@@ -51,23 +65,40 @@ func (c *setCommand) run(ctx context.Context, env *env, clients *clients) error
 		return err
 	}
 
-	caCertsData, err := loadParamData(env.stdin, c.path)
-	if err != nil {
-		return fmt.Errorf("unable to load bundle data: %v", err)
+	format := bundleFormat(c.format)
+	switch format {
+	case formatPEM, formatSPIFFE:
+	default:
+		return fmt.Errorf("unknown format %q", c.format)
 	}
 
-	certs, err := pemutil.ParseCertificates(caCertsData)
+	bundleData, err := loadParamData(env.stdin, c.path)
 	if err != nil {
-		return fmt.Errorf("invalid bundle data: %v", err)
+		return fmt.Errorf("unable to load bundle data: %v", err)
 	}
+
 	var caCerts []byte
-	for _, cert := range certs {
-		caCerts = append(caCerts, cert.Raw...)
+	var jwtSigningKeys []*common.JWTKey
+	switch format {
+	case formatSPIFFE:
+		caCerts, jwtSigningKeys, err = parseSPIFFEBundle(bundleData)
+		if err != nil {
+			return fmt.Errorf("invalid bundle data: %v", err)
+		}
+	default:
+		certs, err := pemutil.ParseCertificates(bundleData)
+		if err != nil {
+			return fmt.Errorf("invalid bundle data: %v", err)
+		}
+		for _, cert := range certs {
+			caCerts = append(caCerts, cert.Raw...)
+		}
 	}
 
 	bundle := &registration.FederatedBundle{
 		DEPRECATEDSpiffeId: id,
 		DEPRECATEDCaCerts:  caCerts,
+		JwtSigningKeys:     jwtSigningKeys,
 	}
 
 	// pull the existing bundle to know if this should be a create or a update.
@@ -0,0 +1,183 @@
+package bundle
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/spiffe/spire/proto/common"
+)
+
+// jwtSVIDUse is the JWK "use" value SPIFFE trust domain bundles use to mark
+// a key as a JWT-SVID signing authority, as opposed to an X.509 authority.
+const jwtSVIDUse = "jwt-svid"
+
+// spiffeJWKS is the JSON structure of a SPIFFE trust domain bundle: a JWK
+// Set (RFC 7517) where X.509 authorities carry their certificate chain in
+// "x5c" and JWT authorities are marked with "use": "jwt-svid".
+type spiffeJWKS struct {
+	Keys []spiffeJWK `json:"keys"`
+}
+
+type spiffeJWK struct {
+	Kty string   `json:"kty"`
+	Use string   `json:"use"`
+	Kid string   `json:"kid"`
+	Alg string   `json:"alg"`
+	X5c []string `json:"x5c"`
+
+	// Crv, X, Y and N, E carry the key material for JWT-SVID authorities,
+	// which publish their key as raw JWK parameters (RFC 7518) rather than
+	// an x5c certificate chain.
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// parseSPIFFEBundle parses a SPIFFE trust domain bundle document into the
+// DER-encoded X.509 authorities and JWT signing keys it contains.
+func parseSPIFFEBundle(data []byte) (caCerts []byte, jwtSigningKeys []*common.JWTKey, err error) {
+	jwks := new(spiffeJWKS)
+	if err := json.Unmarshal(data, jwks); err != nil {
+		return nil, nil, fmt.Errorf("unable to parse SPIFFE bundle: %v", err)
+	}
+
+	for _, key := range jwks.Keys {
+		if key.Use == jwtSVIDUse {
+			jwtSigningKey, err := parseJWTSVIDKey(key)
+			if err != nil {
+				return nil, nil, err
+			}
+			jwtSigningKeys = append(jwtSigningKeys, jwtSigningKey)
+			continue
+		}
+
+		// X.509 authorities are published as a certificate chain in x5c;
+		// unlike jwt-svid keys, they have no other representation.
+		if len(key.X5c) == 0 {
+			return nil, nil, fmt.Errorf("X.509 authority %q is missing the x5c chain", key.Kid)
+		}
+		for _, encodedCert := range key.X5c {
+			certBytes, err := base64.StdEncoding.DecodeString(encodedCert)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to decode X.509 authority: %v", err)
+			}
+			cert, err := x509.ParseCertificate(certBytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid X.509 authority: %v", err)
+			}
+			caCerts = append(caCerts, cert.Raw...)
+		}
+	}
+
+	return caCerts, jwtSigningKeys, nil
+}
+
+// parseJWTSVIDKey extracts the signing key out of a "jwt-svid" JWK entry.
+// These entries normally carry their key material as raw JWK parameters
+// (n/e for RSA, crv/x/y for EC) rather than an x5c chain, since a JWT-SVID
+// signing key has no certificate of its own; if an x5c is present anyway,
+// the public key is pulled out of the leaf certificate instead of using the
+// certificate's DER encoding directly, since common.JWTKey.PublicKey is a
+// PKIX-encoded public key, not a certificate.
+func parseJWTSVIDKey(key spiffeJWK) (*common.JWTKey, error) {
+	pub, err := jwtSVIDPublicKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT authority %q: %v", key.Kid, err)
+	}
+
+	pkixBytes, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode JWT authority %q: %v", key.Kid, err)
+	}
+
+	return &common.JWTKey{
+		Kid:       key.Kid,
+		PublicKey: pkixBytes,
+		Algorithm: key.Alg,
+	}, nil
+}
+
+func jwtSVIDPublicKey(key spiffeJWK) (interface{}, error) {
+	if len(key.X5c) > 0 {
+		certBytes, err := base64.StdEncoding.DecodeString(key.X5c[0])
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode x5c: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certBytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x5c certificate: %v", err)
+		}
+		return cert.PublicKey, nil
+	}
+
+	switch key.Kty {
+	case "RSA":
+		return parseRSAJWK(key)
+	case "EC":
+		return parseECJWK(key)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", key.Kty)
+	}
+}
+
+func parseRSAJWK(key spiffeJWK) (*rsa.PublicKey, error) {
+	if key.N == "" || key.E == "" {
+		return nil, fmt.Errorf("RSA key is missing the n/e parameters")
+	}
+	n, err := base64.RawURLEncoding.DecodeString(key.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RSA modulus: %v", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(key.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RSA exponent: %v", err)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+func parseECJWK(key spiffeJWK) (*ecdsa.PublicKey, error) {
+	curve, err := ecJWKCurve(key.Crv)
+	if err != nil {
+		return nil, err
+	}
+	if key.X == "" || key.Y == "" {
+		return nil, fmt.Errorf("EC key is missing the x/y parameters")
+	}
+	x, err := base64.RawURLEncoding.DecodeString(key.X)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EC x coordinate: %v", err)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(key.Y)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EC y coordinate: %v", err)
+	}
+	return &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}, nil
+}
+
+func ecJWKCurve(crv string) (elliptic.Curve, error) {
+	switch crv {
+	case "P-256":
+		return elliptic.P256(), nil
+	case "P-384":
+		return elliptic.P384(), nil
+	case "P-521":
+		return elliptic.P521(), nil
+	default:
+		return nil, fmt.Errorf("unsupported EC curve %q", crv)
+	}
+}
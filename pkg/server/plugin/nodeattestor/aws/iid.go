@@ -0,0 +1,491 @@
+package aws
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/fullsailor/pkcs7"
+	"github.com/hashicorp/hcl"
+
+	caws "github.com/spiffe/spire/pkg/common/plugin/aws"
+	spi "github.com/spiffe/spire/proto/common/plugin"
+	"github.com/spiffe/spire/proto/server/nodeattestor"
+)
+
+// This is the AWS CA certificate used to verify the legacy RSA-SHA256
+// signature over the instance identity document when no other key is
+// configured. It can be downloaded from
+// https://aws.amazon.com/security/aws-signing-certificate/
+//
+// There is no equivalent built-in default for the PKCS7 rsa2048 signature:
+// AWS publishes a distinct rsa2048 signing certificate per partition
+// ("aws", "aws-cn", "aws-us-gov"), and an operator must supply the genuine
+// certificate for each partition they expect to attest instances from via
+// the rsa2048_ca_certs configuration.
+const awsCaCertPEM = `-----BEGIN CERTIFICATE-----
+MIIDIjCCAougAwIBAgIJAKnL4UEDMN/FMA0GCSqGSIb3DQEBBQUAMGoxCzAJBgNV
+BAYTAlVTMRMwEQYDVQQIEwpXYXNoaW5ndG9uMRAwDgYDVQQHEwdTZWF0dGxlMSAw
+HgYDVQQKExdBbWF6b24gV2ViIFNlcnZpY2VzIExMQzEUMBIGA1UEAxMLYXdzLmFt
+YXpvbi5jb20wHhcNMTAwMTIwMjMyMDUwWhcNMzgwMTIwMjMyMDUwWjBqMQswCQYD
+VQQGEwJVUzETMBEGA1UECBMKV2FzaGluZ3RvbjEQMA4GA1UEBxMHU2VhdHRsZTEg
+MB4GA1UEChMXQW1hem9uIFdlYiBTZXJ2aWNlcyBMTEMxFDASBgNVBAMTC2F3cy5h
+bWF6b24uY29tMIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAk6rCIk++
+1fL51ZBzFwglmMz2/pbxXMNz63yWu3jf41wD69eKN15vgHyZom1qj38pgfKx7dvQ
+x2aW5nvj/qinWD0mPm3GX1+hAeOROFeY9gOCG1jV8KvFgzQVd2k5AU8pyQoa9ZTx
+sKM6/w5JEpClIUG1IlEbgqfGOsDc6nNocD9gsq/ew5BBSR3B7O4QmAUTLPJHJomj
+nTqcQxLHY44HmgXSKRRKGdaALe/tJ8H+U13Cu+OjEbFnjD4u0ENMhhX3Cy5/dDPL
+VkckRtpN0YnJoWlZq08MSfhYbWhoDfhV4fcbaXZb/mU7G4iTdPF9Dd5yKcEblKrb
+TAmZ2mJczqfFiwIDAQABo1AwTjAdBgNVHQ4EFgQU7GM0/3JtSoF0U0fXZWkLaQfH
+OzswHwYDVR0jBBgwFoAU7GM0/3JtSoF0U0fXZWkLaQfHOzswDAYDVR0TBAUwAwEB
+/zANBgkqhkiG9w0BAQUFAAOCAQEAf/nHE5U5e0mlQe4+/vGvBdDtjYuyLaH/E2rB
+sZv+tKC1WXyz1B+a5nfGw3I5cPpNX9TYn4DhIwK1bQpOtj8kNGB8Vs2Ub1c6CsRl
+5pZK21r4KzCp1Q8PIYGFVe9nz7o3MqIw0IlOK5Tsyq2pZSFDq3zqQpHa6X3OmDH0
+PRtCCPPD7HRdw7XQBiGfr9j+2OSqaRVz3rdE2G0lXZqeIuBkpjrTvqXfLa3t7HVW
+9ZOKqR2GRXOQyWeD5Tzit1X/xNB3tZ6vE5jE1yD7Q4UwvdpHTdCTY6F6sdaFXBj4
+J+mj9LzHTzyPOxXw1zJsVeDLVRDMRsvB6rVf0QRPOS2aPw==
+-----END CERTIFICATE-----`
+
+const (
+	// defaultAgentPathTemplate is used when no agent_path_template is configured.
+	defaultAgentPathTemplate = "{{ .PluginName}}/{{ .AccountID }}/{{ .Region }}/{{ .InstanceID }}"
+
+	// legacyCertKey and rsa2048CertKey index awsCaCerts. rsa2048CertKey
+	// holds the commercial "aws" partition's rsa2048 certificate;
+	// rsa2048CertMapKey derives the keys for other partitions.
+	legacyCertKey  = "legacy"
+	rsa2048CertKey = "rsa2048"
+)
+
+// EC2Client is the subset of the AWS EC2 API used by the plugin. It exists so
+// tests can substitute a mock implementation.
+type EC2Client interface {
+	DescribeInstancesWithContext(ctx awssdk.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error)
+}
+
+// IIDAttestorConfig is the configuration in effect for the plugin, built from
+// IIDAttestorHCLConfig plus the current global configuration.
+type IIDAttestorConfig struct {
+	trustDomain string
+
+	// awsCaCerts holds the AWS CA certificates used to verify the instance
+	// identity document's signature: one entry at legacyCertKey for the
+	// plain RSA-SHA256 signature, plus one entry per AWS partition (see
+	// rsa2048CertMapKey) for the PKCS7 rsa2048 signature, since AWS
+	// publishes a distinct rsa2048 certificate per partition.
+	awsCaCerts map[string]*x509.Certificate
+
+	accessKeyID     string
+	secretAccessKey string
+
+	skipBlockDevice      bool
+	skipEC2AttestCalling bool
+
+	agentPathTemplate *template.Template
+
+	// accountIDsForLocalValidation restricts attestation to instance identity
+	// documents whose AccountID is in this set. Empty means no restriction.
+	accountIDsForLocalValidation map[string]bool
+
+	// instanceMaxAge, when non-zero, rejects documents whose PendingTime is
+	// older than this duration.
+	instanceMaxAge time.Duration
+}
+
+// IIDAttestorHCLConfig is the HCL-decoded configuration for the plugin.
+type IIDAttestorHCLConfig struct {
+	AccessKeyID          string `hcl:"access_key_id"`
+	SecretAccessKey      string `hcl:"secret_access_key"`
+	SkipBlockDevice      bool   `hcl:"skip_block_device"`
+	AgentPathTemplate    string `hcl:"agent_path_template"`
+	SkipEC2AttestCalling bool   `hcl:"skip_ec2_attest_calling"`
+
+	// AccountIDsForLocalValidation is the list of AWS account IDs allowed to
+	// attest. If empty, instances from any account are accepted.
+	AccountIDsForLocalValidation []string `hcl:"account_ids_for_local_validation"`
+
+	// InstanceMaxAge is the maximum allowed time between the instance
+	// identity document's PendingTime and the current time, e.g. "5m". If
+	// empty, no age restriction is enforced.
+	InstanceMaxAge string `hcl:"instance_max_age"`
+
+	// Rsa2048CACerts maps an AWS partition name ("aws", "aws-cn",
+	// "aws-us-gov") to the PEM-encoded CA certificate AWS publishes for
+	// that partition's rsa2048 PKCS7 instance identity document signature.
+	// There is no built-in default: attesting a PKCS7-signed document from
+	// a partition with no entry here fails closed.
+	Rsa2048CACerts map[string]string `hcl:"rsa2048_ca_certs"`
+}
+
+// IIDAttestorPlugin implements node attestation for AWS EC2 instances using
+// the signed instance identity document.
+type IIDAttestorPlugin struct {
+	mtx    sync.RWMutex
+	config *IIDAttestorConfig
+
+	hooks struct {
+		getClient func(p client.ConfigProvider, cfgs ...*awssdk.Config) EC2Client
+		getEnv    func(string) string
+	}
+}
+
+// NewIIDPlugin creates a new IIDAttestorPlugin.
+func NewIIDPlugin() *IIDAttestorPlugin {
+	p := &IIDAttestorPlugin{}
+	p.hooks.getClient = func(conf client.ConfigProvider, cfgs ...*awssdk.Config) EC2Client {
+		return ec2.New(conf, cfgs...)
+	}
+	p.hooks.getEnv = os.Getenv
+	return p
+}
+
+func (p *IIDAttestorPlugin) Configure(ctx context.Context, req *spi.ConfigureRequest) (*spi.ConfigureResponse, error) {
+	extConfig := &IIDAttestorHCLConfig{}
+	if err := hcl.Decode(extConfig, req.Configuration); err != nil {
+		return nil, fmt.Errorf("error parsing AWS IID Attestor configuration: %v", err)
+	}
+
+	if req.GlobalConfig == nil {
+		return nil, errors.New("global configuration is required")
+	}
+	if req.GlobalConfig.TrustDomain == "" {
+		return nil, errors.New("trust_domain is required")
+	}
+
+	if extConfig.AccessKeyID != "" && extConfig.SecretAccessKey == "" {
+		return nil, errors.New("configuration missing secret access key, but has access key id")
+	}
+	if extConfig.SecretAccessKey != "" && extConfig.AccessKeyID == "" {
+		return nil, errors.New("configuration missing access key id, but has secret access key")
+	}
+
+	if extConfig.AccessKeyID == "" {
+		extConfig.AccessKeyID = p.hooks.getEnv(caws.AccessKeyIDVarName)
+	}
+	if extConfig.SecretAccessKey == "" {
+		extConfig.SecretAccessKey = p.hooks.getEnv(caws.SecretAccessKeyVarName)
+	}
+
+	agentPathTemplateText := defaultAgentPathTemplate
+	if extConfig.AgentPathTemplate != "" {
+		agentPathTemplateText = extConfig.AgentPathTemplate
+	}
+	agentPathTemplate, err := template.New("agent-path").Parse(agentPathTemplateText)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse agent svid template: %q: %v", agentPathTemplateText, err)
+	}
+
+	var instanceMaxAge time.Duration
+	if extConfig.InstanceMaxAge != "" {
+		instanceMaxAge, err = time.ParseDuration(extConfig.InstanceMaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse instance_max_age %q: %v", extConfig.InstanceMaxAge, err)
+		}
+	}
+
+	accountIDsForLocalValidation := make(map[string]bool)
+	for _, accountID := range extConfig.AccountIDsForLocalValidation {
+		accountIDsForLocalValidation[accountID] = true
+	}
+
+	awsCaCerts, err := loadAWSCACerts(extConfig.Rsa2048CACerts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load AWS CA certificates: %v", err)
+	}
+
+	config := &IIDAttestorConfig{
+		trustDomain:                  req.GlobalConfig.TrustDomain,
+		awsCaCerts:                   awsCaCerts,
+		accessKeyID:                  extConfig.AccessKeyID,
+		secretAccessKey:              extConfig.SecretAccessKey,
+		skipBlockDevice:              extConfig.SkipBlockDevice,
+		skipEC2AttestCalling:         extConfig.SkipEC2AttestCalling,
+		agentPathTemplate:            agentPathTemplate,
+		accountIDsForLocalValidation: accountIDsForLocalValidation,
+		instanceMaxAge:               instanceMaxAge,
+	}
+
+	p.setConfig(config)
+
+	return &spi.ConfigureResponse{}, nil
+}
+
+func (p *IIDAttestorPlugin) Attest(stream nodeattestor.Attest_PluginStream) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	c, err := p.getConfig()
+	if err != nil {
+		return err
+	}
+
+	attestationData := req.AttestationData
+	if attestationData == nil {
+		return errors.New("request missing attestation data")
+	}
+	if attestationData.Type != caws.PluginName {
+		return fmt.Errorf("unexpected attestation data type %q", attestationData.Type)
+	}
+
+	var attestedData caws.IIDAttestationData
+	if err := json.Unmarshal(attestationData.Data, &attestedData); err != nil {
+		return err
+	}
+
+	if req.AttestedBefore {
+		return errors.New("the IID has been used and is no longer valid")
+	}
+
+	var doc caws.InstanceIdentityDocument
+	if err := json.Unmarshal([]byte(attestedData.Document), &doc); err != nil {
+		return fmt.Errorf("failed to unmarshal the IID: %v", err)
+	}
+
+	// doc.Region only picks which AWS CA certificate verifies the
+	// signature below; it carries no trust of its own until that
+	// verification succeeds.
+	if err := verifyIIDSignature(c, &attestedData, doc.Region); err != nil {
+		return err
+	}
+
+	if len(c.accountIDsForLocalValidation) > 0 && !c.accountIDsForLocalValidation[doc.AccountID] {
+		return fmt.Errorf("account %q is not in the list of allowed AWS accounts", doc.AccountID)
+	}
+
+	if c.instanceMaxAge > 0 {
+		if age := time.Since(doc.PendingTime); age > c.instanceMaxAge {
+			return fmt.Errorf("instance %q is too old: pending for %s, max age is %s", doc.InstanceID, age, c.instanceMaxAge)
+		}
+	}
+
+	if !c.skipEC2AttestCalling {
+		ec2Client := p.hooks.getClient(session.Must(session.NewSession()), awsConfig(c, doc.Region))
+
+		output, err := ec2Client.DescribeInstancesWithContext(context.Background(), &ec2.DescribeInstancesInput{
+			InstanceIds: []*string{&doc.InstanceID},
+		})
+		if err != nil {
+			return err
+		}
+
+		instance := output.Reservations[0].Instances[0]
+		attachment := instance.NetworkInterfaces[0].Attachment
+		if attachment == nil || attachment.DeviceIndex == nil || *attachment.DeviceIndex != 0 {
+			return errors.New("verifying the EC2 instance's NetworkInterface[0].DeviceIndex is 0")
+		}
+
+		if !c.skipBlockDevice && instance.RootDeviceType != nil && *instance.RootDeviceType == ec2.DeviceTypeEbs {
+			var found bool
+			for _, bdm := range instance.BlockDeviceMappings {
+				if bdm.DeviceName == nil || instance.RootDeviceName == nil || *bdm.DeviceName != *instance.RootDeviceName {
+					continue
+				}
+				found = true
+				if bdm.Ebs == nil || bdm.Ebs.DeleteOnTermination == nil || !*bdm.Ebs.DeleteOnTermination {
+					return errors.New("the EC2 instance's root BlockDeviceMapping has DeleteOnTermination disabled")
+				}
+			}
+			if !found {
+				return errors.New("unable to locate a BlockDeviceMapping for the EC2 instance's root device")
+			}
+		}
+	}
+
+	agentID, err := makeAgentID(c, &doc)
+	if err != nil {
+		return err
+	}
+
+	return stream.Send(&nodeattestor.AttestResponse{
+		Valid:        true,
+		BaseSPIFFEID: agentID,
+	})
+}
+
+func (p *IIDAttestorPlugin) GetPluginInfo(ctx context.Context, req *spi.GetPluginInfoRequest) (*spi.GetPluginInfoResponse, error) {
+	return &spi.GetPluginInfoResponse{}, nil
+}
+
+func (p *IIDAttestorPlugin) setConfig(config *IIDAttestorConfig) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.config = config
+}
+
+func (p *IIDAttestorPlugin) getConfig() (*IIDAttestorConfig, error) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	if p.config == nil {
+		return nil, errors.New("aws-iid: not configured")
+	}
+	return p.config, nil
+}
+
+// verifyIIDSignature verifies the signature over the instance identity
+// document, preferring the PKCS7-wrapped RSA-2048 signature when the agent
+// supplied one and falling back to the legacy RSA-SHA256 signature
+// otherwise.
+func verifyIIDSignature(c *IIDAttestorConfig, attestedData *caws.IIDAttestationData, region string) error {
+	if attestedData.SignatureRSA2048 != "" {
+		return verifyPKCS7Signature(c, attestedData, region)
+	}
+	return verifyLegacySignature(c, attestedData)
+}
+
+func verifyLegacySignature(c *IIDAttestorConfig, attestedData *caws.IIDAttestationData) error {
+	sigBytes, err := base64.StdEncoding.DecodeString(attestedData.Signature)
+	if err != nil {
+		return err
+	}
+
+	legacyKey, ok := c.awsCaCerts[legacyCertKey].PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("legacy AWS CA certificate does not use an RSA public key")
+	}
+
+	docHash := sha256.Sum256([]byte(attestedData.Document))
+	if err := rsa.VerifyPKCS1v15(legacyKey, crypto.SHA256, docHash[:], sigBytes); err != nil {
+		return fmt.Errorf("error verifying the cryptographic signature: %v", err)
+	}
+	return nil
+}
+
+func verifyPKCS7Signature(c *IIDAttestorConfig, attestedData *caws.IIDAttestationData, region string) error {
+	sigBytes, err := base64.StdEncoding.DecodeString(attestedData.SignatureRSA2048)
+	if err != nil {
+		return err
+	}
+
+	p7, err := pkcs7.Parse(sigBytes)
+	if err != nil {
+		return fmt.Errorf("error parsing the PKCS7 signature: %v", err)
+	}
+
+	if !bytes.Equal(p7.Content, []byte(attestedData.Document)) {
+		return errors.New("error verifying the cryptographic signature: PKCS7 content does not match the attested document")
+	}
+
+	// AWS publishes a distinct rsa2048 signing certificate per partition
+	// ("aws", "aws-cn", "aws-us-gov"), so pick the truststore based on the
+	// region the document claims; that claim carries no trust of its own,
+	// it just selects which certificate the signature must chain to below.
+	partition := awsPartition(region)
+	cert, ok := c.awsCaCerts[rsa2048CertMapKey(partition)]
+	if !ok {
+		return fmt.Errorf("no rsa2048 AWS CA certificate configured for partition %q", partition)
+	}
+
+	// Verify against a truststore containing only the configured AWS CA
+	// certificate, rather than trusting whichever certificates the PKCS7
+	// blob happens to carry: VerifyWithChain resolves each SignerInfo to its
+	// referenced certificate and checks that it chains to this truststore,
+	// so an attacker can't smuggle in their own signing certificate
+	// alongside a genuine (but unused) AWS certificate.
+	truststore := x509.NewCertPool()
+	truststore.AddCert(cert)
+	if err := p7.VerifyWithChain(truststore); err != nil {
+		return fmt.Errorf("error verifying the cryptographic signature: %v", err)
+	}
+
+	return nil
+}
+
+// awsPartition maps an instance identity document's region to the AWS
+// partition that issues it, since China and GovCloud publish their own
+// rsa2048 signing certificates distinct from the commercial partition.
+func awsPartition(region string) string {
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return "aws-cn"
+	case strings.HasPrefix(region, "us-gov-"):
+		return "aws-us-gov"
+	default:
+		return "aws"
+	}
+}
+
+// rsa2048CertMapKey returns the awsCaCerts key for a partition's rsa2048
+// certificate. The commercial "aws" partition keeps the plain
+// rsa2048CertKey for backward compatibility with existing configuration and
+// tests; the others are suffixed by partition.
+func rsa2048CertMapKey(partition string) string {
+	if partition == "aws" {
+		return rsa2048CertKey
+	}
+	return rsa2048CertKey + ":" + partition
+}
+
+func awsConfig(c *IIDAttestorConfig, region string) *awssdk.Config {
+	conf := awssdk.NewConfig().WithRegion(region)
+	if c.accessKeyID != "" && c.secretAccessKey != "" {
+		conf = conf.WithCredentials(credentials.NewStaticCredentials(c.accessKeyID, c.secretAccessKey, ""))
+	}
+	return conf
+}
+
+type agentPathTemplateData struct {
+	caws.InstanceIdentityDocument
+	PluginName string
+}
+
+func makeAgentID(c *IIDAttestorConfig, doc *caws.InstanceIdentityDocument) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := c.agentPathTemplate.Execute(buf, agentPathTemplateData{
+		InstanceIdentityDocument: *doc,
+		PluginName:               caws.PluginName,
+	}); err != nil {
+		return "", fmt.Errorf("failed to execute agent svid template: %v", err)
+	}
+
+	return fmt.Sprintf("spiffe://%s/spire/agent/%s", c.trustDomain, buf.String()), nil
+}
+
+func loadAWSCACerts(rsa2048CertPEMsByPartition map[string]string) (map[string]*x509.Certificate, error) {
+	legacyCert, err := parseCertPEM(awsCaCertPEM)
+	if err != nil {
+		return nil, fmt.Errorf("legacy AWS CA certificate: %v", err)
+	}
+
+	certs := map[string]*x509.Certificate{
+		legacyCertKey: legacyCert,
+	}
+
+	for partition, certPEM := range rsa2048CertPEMsByPartition {
+		cert, err := parseCertPEM(certPEM)
+		if err != nil {
+			return nil, fmt.Errorf("rsa2048 AWS CA certificate for partition %q: %v", partition, err)
+		}
+		certs[rsa2048CertMapKey(partition)] = cert
+	}
+
+	return certs, nil
+}
+
+func parseCertPEM(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, errors.New("unable to decode AWS CA certificate PEM")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
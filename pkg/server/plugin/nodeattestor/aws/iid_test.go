@@ -6,11 +6,16 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/big"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/spiffe/spire/pkg/common/pemutil"
 
@@ -21,6 +26,7 @@ import (
 	awssdk "github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/fullsailor/pkcs7"
 	"github.com/golang/mock/gomock"
 	"github.com/spiffe/spire/proto/common"
 	"github.com/spiffe/spire/proto/common/plugin"
@@ -61,13 +67,17 @@ type IIDAttestorSuite struct {
 	// built-in for full callstack
 	p      *nodeattestor.BuiltIn
 	rsaKey *rsa.PrivateKey
-	env    map[string]string
+	// rsaCert is a self-signed certificate over rsaKey, standing in for the
+	// AWS CA certificate (since we don't have AWS's private key)
+	rsaCert *x509.Certificate
+	env     map[string]string
 }
 
 func (s *IIDAttestorSuite) SetupTest() {
 	rsaKey, err := pemutil.ParseRSAPrivateKey([]byte(testRSAKey))
 	s.Require().NoError(err)
 	s.rsaKey = rsaKey
+	s.rsaCert = s.selfSignedCert(rsaKey)
 
 	s.env = make(map[string]string)
 
@@ -168,6 +178,172 @@ func (s *IIDAttestorSuite) TestErrorOnNoSignature() {
 	s.requireErrorContains(err, "verifying the cryptographic signature")
 }
 
+func (s *IIDAttestorSuite) TestPKCS7Signature() {
+	docBytes, err := json.Marshal(caws.InstanceIdentityDocument{
+		AccountID:  testAccount,
+		InstanceID: testInstance,
+		Region:     testRegion,
+	})
+	s.Require().NoError(err)
+
+	pkcs7DER, pkcs7Cert := s.buildPKCS7SignedDocument(docBytes)
+	mismatchedPKCS7DER, _ := s.buildPKCS7SignedDocument([]byte(`{"accountId":"someone-else"}`))
+	legacySig := s.signLegacy(docBytes)
+
+	_, err = s.p.Configure(context.Background(), &plugin.ConfigureRequest{
+		Configuration: `skip_ec2_attest_calling = true`,
+		GlobalConfig:  &plugin.ConfigureRequest_GlobalConfig{TrustDomain: "example.org"},
+	})
+	s.Require().NoError(err)
+
+	originalLegacyCert := s.plugin.config.awsCaCerts[legacyCertKey]
+	originalRSA2048Cert := s.plugin.config.awsCaCerts[rsa2048CertKey]
+	defer func() {
+		s.plugin.config.awsCaCerts[legacyCertKey] = originalLegacyCert
+		s.plugin.config.awsCaCerts[rsa2048CertKey] = originalRSA2048Cert
+	}()
+	s.plugin.config.awsCaCerts[legacyCertKey] = s.rsaCert
+	s.plugin.config.awsCaCerts[rsa2048CertKey] = pkcs7Cert
+
+	tests := []struct {
+		desc      string
+		pkcs7Sig  string
+		legacySig string
+		expectErr string
+	}{
+		{
+			desc:     "pkcs7 signature only",
+			pkcs7Sig: base64.StdEncoding.EncodeToString(pkcs7DER),
+		},
+		{
+			desc:      "legacy signature only",
+			legacySig: legacySig,
+		},
+		{
+			desc:     "both present, pkcs7 is preferred",
+			pkcs7Sig: base64.StdEncoding.EncodeToString(pkcs7DER),
+			// the legacy signature is well-formed but signs different bytes;
+			// if the attestor fell back to it instead of preferring pkcs7,
+			// this would fail signature verification.
+			legacySig: s.signLegacy([]byte("not the attested document")),
+		},
+		{
+			desc:      "pkcs7 content does not match the attested document",
+			pkcs7Sig:  base64.StdEncoding.EncodeToString(mismatchedPKCS7DER),
+			expectErr: "PKCS7 content does not match the attested document",
+		},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.desc, func(t *testing.T) {
+			data := &common.AttestationData{
+				Type: aws.PluginName,
+				Data: s.iidAttestationDataToBytes(aws.IIDAttestationData{
+					Document:         string(docBytes),
+					Signature:        tt.legacySig,
+					SignatureRSA2048: tt.pkcs7Sig,
+				}),
+			}
+
+			resp, err := s.attest(&nodeattestor.AttestRequest{AttestationData: data})
+			if tt.expectErr != "" {
+				s.Nil(resp)
+				s.requireErrorContains(err, tt.expectErr)
+				return
+			}
+
+			s.Require().NoError(err)
+			s.Require().NotNil(resp)
+			s.True(resp.Valid)
+		})
+	}
+}
+
+// TestPKCS7SignatureRequiresPartitionCert exercises the per-partition
+// rsa2048 cert selection: AWS publishes a distinct rsa2048 signing
+// certificate for each partition (aws, aws-cn, aws-us-gov), so a document
+// claiming a China or GovCloud region must be verified against that
+// partition's own configured certificate, not the commercial one, and must
+// fail closed if that partition has no certificate configured at all.
+//
+// This test uses a self-signed certificate as the partition's "configured"
+// cert, the same as the rest of this file; it does not assert against AWS's
+// actual published rsa2048 certificates, which aren't available in this
+// environment.
+func (s *IIDAttestorSuite) TestPKCS7SignatureRequiresPartitionCert() {
+	docBytes, err := json.Marshal(caws.InstanceIdentityDocument{
+		AccountID:  testAccount,
+		InstanceID: testInstance,
+		Region:     "cn-north-1",
+	})
+	s.Require().NoError(err)
+	pkcs7DER, pkcs7Cert := s.buildPKCS7SignedDocument(docBytes)
+
+	_, err = s.p.Configure(context.Background(), &plugin.ConfigureRequest{
+		Configuration: `skip_ec2_attest_calling = true`,
+		GlobalConfig:  &plugin.ConfigureRequest_GlobalConfig{TrustDomain: "example.org"},
+	})
+	s.Require().NoError(err)
+
+	// the commercial partition's cert would verify the signature, so the
+	// failure below shows it is not consulted for an aws-cn document.
+	s.plugin.config.awsCaCerts[rsa2048CertKey] = pkcs7Cert
+	defer delete(s.plugin.config.awsCaCerts, rsa2048CertKey)
+
+	data := &common.AttestationData{
+		Type: aws.PluginName,
+		Data: s.iidAttestationDataToBytes(aws.IIDAttestationData{
+			Document:         string(docBytes),
+			SignatureRSA2048: base64.StdEncoding.EncodeToString(pkcs7DER),
+		}),
+	}
+
+	_, err = s.attest(&nodeattestor.AttestRequest{AttestationData: data})
+	s.requireErrorContains(err, `no rsa2048 AWS CA certificate configured for partition "aws-cn"`)
+
+	s.plugin.config.awsCaCerts[rsa2048CertMapKey("aws-cn")] = pkcs7Cert
+	defer delete(s.plugin.config.awsCaCerts, rsa2048CertMapKey("aws-cn"))
+
+	resp, err := s.attest(&nodeattestor.AttestRequest{AttestationData: data})
+	s.Require().NoError(err)
+	s.Require().NotNil(resp)
+	s.True(resp.Valid)
+}
+
+func (s *IIDAttestorSuite) selfSignedCert(key *rsa.PrivateKey) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test-aws-ca"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	s.Require().NoError(err)
+	cert, err := x509.ParseCertificate(certDER)
+	s.Require().NoError(err)
+	return cert
+}
+
+func (s *IIDAttestorSuite) buildPKCS7SignedDocument(docBytes []byte) ([]byte, *x509.Certificate) {
+	cert := s.selfSignedCert(s.rsaKey)
+
+	signedData, err := pkcs7.NewSignedData(docBytes)
+	s.Require().NoError(err)
+	s.Require().NoError(signedData.AddSigner(cert, s.rsaKey, pkcs7.SignerInfoConfig{}))
+	der, err := signedData.Finish()
+	s.Require().NoError(err)
+
+	return der, cert
+}
+
+func (s *IIDAttestorSuite) signLegacy(docBytes []byte) string {
+	docHash := sha256.Sum256(docBytes)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.rsaKey, crypto.SHA256, docHash[:])
+	s.Require().NoError(err)
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
 func (s *IIDAttestorSuite) TestClientAndIDReturns() {
 	zeroDeviceIndex := int64(0)
 	nonzeroDeviceIndex := int64(1)
@@ -182,6 +358,9 @@ func (s *IIDAttestorSuite) TestClientAndIDReturns() {
 		replacementTemplate string
 		skipEC2             bool
 		skipBlockDev        bool
+		allowedAccountIDs   []string
+		instanceMaxAge      string
+		pendingTimeAge      time.Duration
 	}{
 		{
 			desc: "error on call",
@@ -247,6 +426,32 @@ func (s *IIDAttestorSuite) TestClientAndIDReturns() {
 			replacementTemplate: "{{ .PluginName}}/{{ .Region }}/{{ .AccountID }}/{{ .InstanceID }}",
 			expectID:            "spiffe://example.org/spire/agent/aws_iid/test-region/test-account/test-instance",
 		},
+		{
+			desc:              "success, account in allow-list",
+			skipEC2:           true,
+			allowedAccountIDs: []string{"other-account", testAccount},
+			expectID:          "spiffe://example.org/spire/agent/aws_iid/test-account/test-region/test-instance",
+		},
+		{
+			desc:              "error, account not in allow-list",
+			skipEC2:           true,
+			allowedAccountIDs: []string{"other-account"},
+			expectErr:         `account "test-account" is not in the list of allowed AWS accounts`,
+		},
+		{
+			desc:           "success, instance within max age",
+			skipEC2:        true,
+			instanceMaxAge: "5m",
+			pendingTimeAge: time.Minute,
+			expectID:       "spiffe://example.org/spire/agent/aws_iid/test-account/test-region/test-instance",
+		},
+		{
+			desc:           "error, instance older than max age",
+			skipEC2:        true,
+			instanceMaxAge: "5m",
+			pendingTimeAge: 10 * time.Minute,
+			expectErr:      `instance "test-instance" is too old`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -278,6 +483,16 @@ func (s *IIDAttestorSuite) TestClientAndIDReturns() {
 			if tt.skipBlockDev {
 				configStr = configStr + "\nskip_block_device = true"
 			}
+			if len(tt.allowedAccountIDs) > 0 {
+				quoted := make([]string, 0, len(tt.allowedAccountIDs))
+				for _, id := range tt.allowedAccountIDs {
+					quoted = append(quoted, fmt.Sprintf("%q", id))
+				}
+				configStr = configStr + fmt.Sprintf("\naccount_ids_for_local_validation = [%s]", strings.Join(quoted, ", "))
+			}
+			if tt.instanceMaxAge != "" {
+				configStr = configStr + fmt.Sprintf("\ninstance_max_age = %q", tt.instanceMaxAge)
+			}
 
 			_, err := s.p.Configure(context.Background(), &plugin.ConfigureRequest{
 				Configuration: configStr,
@@ -285,17 +500,22 @@ func (s *IIDAttestorSuite) TestClientAndIDReturns() {
 			})
 			s.Require().NoError(err)
 
+			pendingTime := time.Now()
+			if tt.pendingTimeAge != 0 {
+				pendingTime = pendingTime.Add(-tt.pendingTimeAge)
+			}
+
 			data := &common.AttestationData{
 				Type: aws.PluginName,
-				Data: s.iidAttestationDataToBytes(*s.buildDefaultIIDAttestationData()),
+				Data: s.iidAttestationDataToBytes(*s.buildIIDAttestationDataWithPendingTime(testInstance, testAccount, testRegion, pendingTime)),
 			}
 
 			// using our own keypair (since we don't have AWS private key)
-			originalAWSPublicKey := s.plugin.config.awsCaCertPublicKey
+			originalAWSCert := s.plugin.config.awsCaCerts[legacyCertKey]
 			defer func() {
-				s.plugin.config.awsCaCertPublicKey = originalAWSPublicKey
+				s.plugin.config.awsCaCerts[legacyCertKey] = originalAWSCert
 			}()
-			s.plugin.config.awsCaCertPublicKey = &s.rsaKey.PublicKey
+			s.plugin.config.awsCaCerts[legacyCertKey] = s.rsaCert
 
 			resp, err := s.attest(&nodeattestor.AttestRequest{
 				AttestationData: data,
@@ -452,11 +672,16 @@ func (s *IIDAttestorSuite) requireErrorContains(err error, substring string) {
 }
 
 func (s *IIDAttestorSuite) buildIIDAttestationData(instanceID, accountID, region string) *aws.IIDAttestationData {
+	return s.buildIIDAttestationDataWithPendingTime(instanceID, accountID, region, time.Now())
+}
+
+func (s *IIDAttestorSuite) buildIIDAttestationDataWithPendingTime(instanceID, accountID, region string, pendingTime time.Time) *aws.IIDAttestationData {
 	// doc body
 	doc := aws.InstanceIdentityDocument{
-		AccountID:  accountID,
-		InstanceID: instanceID,
-		Region:     region,
+		AccountID:   accountID,
+		InstanceID:  instanceID,
+		Region:      region,
+		PendingTime: pendingTime,
 	}
 	docBytes, err := json.Marshal(doc)
 	s.Require().NoError(err)
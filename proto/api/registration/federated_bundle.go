@@ -0,0 +1,26 @@
+package registration
+
+import (
+	"github.com/spiffe/spire/proto/common"
+)
+
+// FederatedBundle is a trust bundle for a foreign trust domain, as known to
+// the registration API.
+//
+// DEPRECATEDSpiffeId and DEPRECATEDCaCerts retain the original raw
+// SPIFFE-ID/concatenated-DER-certificates representation for backward
+// compatibility with callers that predate the SPIFFE Trust Domain bundle
+// format. JwtSigningKeys carries the JWT-SVID authorities parsed out of a
+// SPIFFE JWKS bundle alongside those X.509 authorities; it has no DEPRECATED
+// equivalent since it didn't exist before the JWKS format was supported.
+type FederatedBundle struct {
+	DEPRECATEDSpiffeId string
+	DEPRECATEDCaCerts  []byte
+	JwtSigningKeys     []*common.JWTKey
+}
+
+// FederatedBundleID identifies a FederatedBundle by the SPIFFE ID of its
+// trust domain.
+type FederatedBundleID struct {
+	Id string
+}
@@ -0,0 +1,19 @@
+package common
+
+// JWTKey represents a JWT-SVID signing key published in a trust domain's
+// bundle.
+type JWTKey struct {
+	// Kid is the key ID, matched against a JWT-SVID's "kid" header.
+	Kid string
+
+	// PublicKey is the DER-encoded PKIX public key.
+	PublicKey []byte
+
+	// Algorithm is the JWA signing algorithm the key is used with (e.g.
+	// "RS256", "ES256"), taken from the bundle's "alg" JWK parameter.
+	Algorithm string
+
+	// NotAfter is the unix time, in seconds, after which the key is no
+	// longer valid. Zero means the key does not expire.
+	NotAfter int64
+}